@@ -3,22 +3,70 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"go/build/constraint"
+	"go/format"
+	"go/parser"
+	"go/token"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 var (
-	logfile = flag.String("log", "vendor-log", "file `name` for list of commit ids")
+	logfile        = flag.String("log", "vendor-log", "file `name` for list of commit ids")
+	manifestfile   = flag.String("manifest", "vendor.lock", "file `name` for the structured vendor manifest")
+	verifyFlag     = flag.Bool("verify", false, "re-hash vendored packages and fail if any drift from the manifest")
+	updateFlag     = flag.Bool("update", false, "refresh manifest entries for the named packages (or all, if none given) without re-vendoring")
+	jobs           = flag.Int("j", runtime.NumCPU(), "number of concurrent workers for copying files")
+	platformsFlag  = flag.String("platforms", "", "comma-separated `GOOS/GOARCH` pairs to union file sets across (default: host only)")
+	allPlatforms   = flag.Bool("all-platforms", false, "union file sets across every platform reported by 'go tool dist list'")
+	prefixFlag     = flag.String("prefix", "", "if set, vendor into `<prefix>/<importpath>` instead of vendor/<importpath>, rewriting imports between vendored packages to match")
+	pruneFlag      = flag.Bool("prune", false, "omit IgnoredGoFiles not needed by any vendored platform")
+	requireLicense = flag.Bool("require-license", false, "fail if any vendored package has no LICENSE/COPYING/NOTICE/PATENTS file")
 )
 
+// pkgPool bounds how many packages are being listed/copied at once, and
+// copyPool bounds how many individual files are being copied at once
+// (shared across every package's copyPackage call). They're kept separate
+// so a package worker blocked waiting on file-copy workers can never
+// starve the pool it's itself occupying a slot in. Both are sized from
+// -j in main, after flags are parsed.
+var pkgPool *workerPool
+var copyPool *workerPool
+
+// workerPool bounds concurrency to n simultaneous goroutines; callers
+// track their own completion (e.g. via a sync.WaitGroup) since a single
+// pool is shared across many independent batches of work.
+type workerPool struct {
+	sem chan struct{}
+}
+
+func newWorkerPool(n int) *workerPool {
+	if n < 1 {
+		n = 1
+	}
+	return &workerPool{sem: make(chan struct{}, n)}
+}
+
+func (w *workerPool) run(fn func()) {
+	w.sem <- struct{}{}
+	go func() {
+		defer func() { <-w.sem }()
+		fn()
+	}()
+}
+
 type Package struct {
 	Dir           string // directory containing package sources
 	ImportPath    string // import path of package in dir
@@ -78,31 +126,104 @@ func main() {
 	log.SetPrefix("vendor: ")
 
 	flag.Parse()
+	pkgPool = newWorkerPool(*jobs)
+	copyPool = newWorkerPool(*jobs)
+	var err error
+	targetPlatforms, err = resolvePlatforms()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch {
+	case *verifyFlag:
+		if err := verifyManifest(*manifestfile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case *updateFlag:
+		if err := updateManifest(flag.Args(), *manifestfile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	vendor(flag.Args(), true)
 	reportExtVendoredDep()
-	err := reportManifest(*logfile)
+	reportMissingLicense()
+
+	if *prefixFlag != "" {
+		if err := rewriteImports(*prefixFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var lockWG sync.WaitGroup
+	for imp, p := range manifest {
+		imp, p := imp, p
+		lockWG.Add(1)
+		pkgPool.run(func() {
+			defer lockWG.Done()
+			entry, err := buildLockEntry(p)
+			if err != nil {
+				log.Printf("%s: building manifest entry: %v", imp, err)
+				return
+			}
+			manifestMu.Lock()
+			lockEntries[imp] = entry
+			manifestMu.Unlock()
+		})
+	}
+	lockWG.Wait()
+
+	err = reportManifest(*logfile)
 	if err != nil {
 		log.Print(err)
 	}
+	if err := writeManifestEntries(*manifestfile); err != nil {
+		log.Print(err)
+	}
+}
+
+// vendorRoot is the directory vendored packages are copied under:
+// vendor/ by default, or -prefix if one was given.
+func vendorRoot() string {
+	if *prefixFlag != "" {
+		return strings.TrimRight(*prefixFlag, "/")
+	}
+	return "vendor"
 }
 
-var extVendoredDeps map[string]bool
+// manifestMu guards extVendoredDeps, manifest, and lockEntries, all of
+// which are written concurrently by the vendor() worker goroutines.
+var manifestMu sync.Mutex
+
+var extVendoredDeps = map[string]bool{}
 
 func noteExtVendoredDep(p *Package) {
-	if extVendoredDeps == nil {
-		extVendoredDeps = make(map[string]bool)
-	}
-	path := p.ImportPath
-	if extVendoredDeps[path] {
-		return
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	extVendoredDeps[p.ImportPath] = true
+}
+
+// licenseDirsCopied tracks which license destination directories have
+// already been claimed, so two packages sharing an ancestor license (a
+// repo root, say) don't race to copy the same files into it.
+var licenseDirsCopied = map[string]bool{}
+
+// claimLicenseDir reports whether the caller is the first to claim destDir
+// for copying license files into.
+func claimLicenseDir(destDir string) bool {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	if licenseDirsCopied[destDir] {
+		return false
 	}
-	extVendoredDeps[path] = true
+	licenseDirsCopied[destDir] = true
+	return true
 }
 
 func reportExtVendoredDep() {
 	for k, _ := range extVendoredDeps {
-		_, err := os.Stat(filepath.Join(getwd(), "vendor", k))
+		_, err := os.Stat(filepath.Join(getwd(), vendorRoot(), k))
 		if err != nil {
 			if os.IsNotExist(err) {
 				fmt.Println(k)
@@ -113,10 +234,43 @@ func reportExtVendoredDep() {
 	}
 }
 
+// reportMissingLicense warns, to stderr, about every vendored package
+// that copyLicenses found no LICENSE/COPYING/NOTICE/PATENTS file for, and
+// fails the run if -require-license was given.
+func reportMissingLicense() {
+	if len(missingLicense) == 0 {
+		return
+	}
+	sort.Strings(missingLicense)
+	for _, imp := range missingLicense {
+		fmt.Fprintf(os.Stderr, "vendor: %s: no LICENSE/COPYING/NOTICE/PATENTS file found\n", imp)
+	}
+	if *requireLicense {
+		log.Fatalf("%d vendored package(s) missing a license file", len(missingLicense))
+	}
+}
+
 var manifest = map[string]*Package{}
 
-func noteManifest(p *Package) {
+// missingLicense collects the import paths of vendored packages for which
+// no LICENSE/COPYING/NOTICE/PATENTS file was found anywhere between the
+// package directory and its repo root. Guarded by manifestMu, like
+// manifest itself.
+var missingLicense []string
+
+// claimManifest atomically checks whether p.ImportPath has already been
+// claimed for vendoring by another worker and, if not, claims it. This is
+// the dedupe point: with a worker pool processing many packages at once,
+// the same import path can turn up as a dependency of several packages in
+// the same batch.
+func claimManifest(p *Package) bool {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	if manifest[p.ImportPath] != nil {
+		return false
+	}
 	manifest[p.ImportPath] = p
+	return true
 }
 
 func reportManifest(name string) error {
@@ -140,35 +294,86 @@ func reportManifest(name string) error {
 	return w.Flush()
 }
 
+// vendor lists names (a single batched "go list -json" call) and vendors
+// whichever of them need it, in parallel across a worker pool. If andDeps
+// is set, every dependency discovered across this whole batch is
+// collected into one set and handed to a single recursive call, rather
+// than recursing per-package, so the next level is listed in one batch
+// too.
 func vendor(names []string, andDeps bool) {
 	ps, err := listPackages(names)
 	if err != nil {
 		log.Fatalf("error encountered listing packages: %v", err)
 	}
+
+	var wg sync.WaitGroup
+	var depsMu sync.Mutex
+	seenDep := map[string]bool{}
+	var deps []string
+
 	for _, p := range ps {
-		if p.Error != nil {
-			log.Printf("encountered package error: %v", p.Error.Err)
-			continue
-		}
-		if p.Standard {
-			continue
-		}
-		if isVendored(p) {
-			if !isLocal(p) {
-				noteExtVendoredDep(p)
+		p := p
+		wg.Add(1)
+		pkgPool.run(func() {
+			defer wg.Done()
+			vendorPackage(p)
+			if andDeps {
+				depsMu.Lock()
+				for _, d := range p.Deps {
+					if !seenDep[d] {
+						seenDep[d] = true
+						deps = append(deps, d)
+					}
+				}
+				depsMu.Unlock()
 			}
-			continue
-		}
+		})
+	}
+	wg.Wait()
+
+	if andDeps && len(deps) > 0 {
+		vendor(deps, false)
+	}
+}
+
+// vendorPackage copies a single listed package into vendor/, if it needs
+// it, claiming it in the manifest. It's safe to call concurrently for
+// different (or even the same) packages. Lock entries are built
+// separately, once the whole run (and any -prefix import rewrite) has
+// finished, so their file hashes reflect the final copied content.
+func vendorPackage(p *Package) {
+	if p.Error != nil {
+		log.Printf("encountered package error: %v", p.Error.Err)
+		return
+	}
+	if p.Standard {
+		return
+	}
+	if isVendored(p) {
 		if !isLocal(p) {
-			if err := copyPackage(p); err != nil {
-				log.Printf("error copying package %s: %v", p.ImportPath, err)
-				continue
-			}
-			noteManifest(p)
-		}
-		if andDeps {
-			vendor(p.Deps, false)
+			noteExtVendoredDep(p)
 		}
+		return
+	}
+	if isLocal(p) {
+		return
+	}
+	if !claimManifest(p) {
+		return
+	}
+	if err := copyPackage(p); err != nil {
+		log.Printf("error copying package %s: %v", p.ImportPath, err)
+		return
+	}
+	found, err := copyLicenses(p)
+	if err != nil {
+		log.Printf("%s: copying license files: %v", p.ImportPath, err)
+		return
+	}
+	if !found {
+		manifestMu.Lock()
+		missingLicense = append(missingLicense, p.ImportPath)
+		manifestMu.Unlock()
 	}
 }
 
@@ -193,11 +398,121 @@ func isLocal(d *Package) bool {
 	return strings.HasPrefix(d.Dir, getwd())
 }
 
-// listPackages returns all packages in name
+// platform is a GOOS/GOARCH pair to list packages under.
+type platform struct {
+	GOOS, GOARCH string
+}
+
+func (pl platform) String() string { return pl.GOOS + "/" + pl.GOARCH }
+
+// targetPlatforms is the set of platforms listPackages unions file sets
+// across. It's set once in main from -platforms/-all-platforms; nil (the
+// default) means "just the host", preserving the original behavior.
+var targetPlatforms []platform
+
+// resolvePlatforms turns -platforms/-all-platforms into a concrete
+// platform list, or nil if neither was given.
+func resolvePlatforms() ([]platform, error) {
+	if *allPlatforms {
+		return distPlatforms()
+	}
+	if strings.TrimSpace(*platformsFlag) == "" {
+		return nil, nil
+	}
+	var ps []platform
+	for _, s := range strings.Split(*platformsFlag, ",") {
+		s = strings.TrimSpace(s)
+		osarch := strings.SplitN(s, "/", 2)
+		if len(osarch) != 2 || osarch[0] == "" || osarch[1] == "" {
+			return nil, fmt.Errorf("invalid -platforms entry %q, want GOOS/GOARCH", s)
+		}
+		ps = append(ps, platform{osarch[0], osarch[1]})
+	}
+	return ps, nil
+}
+
+// distPlatforms lists every platform the local Go toolchain knows how to
+// build for, backing -all-platforms.
+func distPlatforms() ([]platform, error) {
+	out, err := exec.Command("go", "tool", "dist", "list").Output()
+	if err != nil {
+		return nil, fmt.Errorf("go tool dist list: %v", err)
+	}
+	var ps []platform
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		line = strings.TrimSpace(line)
+		osarch := strings.SplitN(line, "/", 2)
+		if len(osarch) != 2 {
+			continue
+		}
+		ps = append(ps, platform{osarch[0], osarch[1]})
+	}
+	return ps, nil
+}
+
+// listPackages returns all packages in names. If targetPlatforms is set,
+// it lists names once per platform and unions the resulting file sets per
+// import path, so e.g. a package's GOOS-specific files are copied even
+// though the host's own listing would have reported them as ignored.
 func listPackages(names []string) ([]*Package, error) {
-	args := append([]string{"list", "-json"}, names...)
+	if len(targetPlatforms) == 0 {
+		return listPackagesFor(names, nil)
+	}
+
+	merged := map[string]*Package{}
+	var order []string
+	for i := range targetPlatforms {
+		plat := targetPlatforms[i]
+		ps, err := listPackagesFor(names, &plat)
+		if err != nil {
+			return nil, fmt.Errorf("listing packages for %s: %v", plat, err)
+		}
+		for _, p := range ps {
+			existing, ok := merged[p.ImportPath]
+			switch {
+			case !ok:
+				merged[p.ImportPath] = p
+				order = append(order, p.ImportPath)
+			case existing.Error != nil && p.Error == nil:
+				// An earlier platform had no files for this package at
+				// all (e.g. a *_linux.go-only subpackage under
+				// GOOS=darwin); this platform does, so it becomes the
+				// base listing instead of being unioned into the
+				// error stub.
+				merged[p.ImportPath] = p
+			case p.Error != nil:
+				// This platform has nothing to contribute.
+			default:
+				unionPackageFiles(existing, p)
+			}
+		}
+	}
+
+	ps := make([]*Package, 0, len(order))
+	for _, imp := range order {
+		p := merged[imp]
+		pruneIgnoredGoFiles(p)
+		warnIgnoredWithoutConstraint(p)
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// listPackagesFor runs "go list -json" over names, optionally under the
+// given platform's GOOS/GOARCH, decoding the streamed JSON objects it
+// prints. -e asks go list to report per-package errors (via Package.Error)
+// instead of failing the whole invocation, which matters most for a
+// targeted platform: a package with no files at all for that GOOS/GOARCH
+// (e.g. a *_linux.go-only subpackage, listed under GOOS=darwin) is exactly
+// the kind of per-platform gap -platforms/-all-platforms is meant to paper
+// over, not a reason to abort the run.
+func listPackagesFor(names []string, plat *platform) ([]*Package, error) {
+	args := append([]string{"list", "-json", "-e"}, names...)
 	cmd := exec.Command("go", args...)
 	cmd.Stderr = os.Stderr
+	if plat != nil {
+		cmd.Env = append(os.Environ(), "GOOS="+plat.GOOS, "GOARCH="+plat.GOARCH)
+	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -224,16 +539,151 @@ func listPackages(names []string) ([]*Package, error) {
 	return ps, nil
 }
 
+// unionPackageFiles merges src's file lists, imports, and deps into dst,
+// which already holds another platform's listing of the same import path.
+func unionPackageFiles(dst, src *Package) {
+	dst.GoFiles = unionStrings(dst.GoFiles, src.GoFiles)
+	dst.CgoFiles = unionStrings(dst.CgoFiles, src.CgoFiles)
+	dst.IgnoredGoFiles = unionStrings(dst.IgnoredGoFiles, src.IgnoredGoFiles)
+	dst.CFiles = unionStrings(dst.CFiles, src.CFiles)
+	dst.CXXFiles = unionStrings(dst.CXXFiles, src.CXXFiles)
+	dst.MFiles = unionStrings(dst.MFiles, src.MFiles)
+	dst.HFiles = unionStrings(dst.HFiles, src.HFiles)
+	dst.SFiles = unionStrings(dst.SFiles, src.SFiles)
+	dst.SwigFiles = unionStrings(dst.SwigFiles, src.SwigFiles)
+	dst.SwigCXXFiles = unionStrings(dst.SwigCXXFiles, src.SwigCXXFiles)
+	dst.SysoFiles = unionStrings(dst.SysoFiles, src.SysoFiles)
+	dst.Imports = unionStrings(dst.Imports, src.Imports)
+	dst.Deps = unionStrings(dst.Deps, src.Deps)
+}
+
+// pruneIgnoredGoFiles drops any file from p.IgnoredGoFiles that's also
+// present in one of the real (included) file lists, which happens once
+// unionPackageFiles has merged in a platform where that file wasn't
+// ignored.
+func pruneIgnoredGoFiles(p *Package) {
+	included := map[string]bool{}
+	for _, fs := range [][]string{
+		p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.MFiles,
+		p.HFiles, p.SFiles, p.SwigFiles, p.SwigCXXFiles, p.SysoFiles,
+	} {
+		for _, f := range fs {
+			included[f] = true
+		}
+	}
+	var kept []string
+	for _, f := range p.IgnoredGoFiles {
+		if !included[f] {
+			kept = append(kept, f)
+		}
+	}
+	p.IgnoredGoFiles = kept
+}
+
+// unionStrings returns the deduplicated concatenation of a and b,
+// preserving the order elements were first seen in.
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	out := make([]string, 0, len(a)+len(b))
+	for _, ss := range [2][]string{a, b} {
+		for _, s := range ss {
+			if !seen[s] {
+				seen[s] = true
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// knownGOOS and knownGOARCH are the GOOS/GOARCH values go/build recognizes
+// in filename suffixes like foo_linux_amd64.go, used by
+// warnIgnoredWithoutConstraint to tell such files apart from ones ignored
+// for some other, less obvious reason.
+var knownGOOS = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true,
+	"freebsd": true, "hurd": true, "illumos": true, "ios": true, "js": true,
+	"linux": true, "nacl": true, "netbsd": true, "openbsd": true,
+	"plan9": true, "solaris": true, "wasip1": true, "windows": true, "zos": true,
+}
+
+var knownGOARCH = map[string]bool{
+	"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true,
+	"arm64": true, "arm64be": true, "loong64": true, "mips": true,
+	"mips64": true, "mips64le": true, "mips64p32": true, "mips64p32le": true,
+	"mipsle": true, "ppc": true, "ppc64": true, "ppc64le": true,
+	"riscv": true, "riscv64": true, "s390": true, "s390x": true,
+	"sparc": true, "sparc64": true, "wasm": true,
+}
+
+// hasPlatformSuffix reports whether fname's base name ends in a
+// recognized _GOOS, _GOARCH, or _GOOS_GOARCH suffix, which go/build
+// treats as an implicit build constraint even without a //go:build line.
+func hasPlatformSuffix(fname string) bool {
+	base := strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname))
+	parts := strings.Split(base, "_")
+	if len(parts) < 2 {
+		return false
+	}
+	last := parts[len(parts)-1]
+	if knownGOARCH[last] {
+		return true
+	}
+	return knownGOOS[last]
+}
+
+// warnIgnoredWithoutConstraint parses the //go:build or // +build line (if
+// any) of each still-ignored .go file and warns, to stderr, about any file
+// that has neither a recognized platform filename suffix nor a parseable
+// build constraint: such a file was excluded for some platform this run
+// didn't consider, and -platforms/-all-platforms should be widened to
+// include it.
+func warnIgnoredWithoutConstraint(p *Package) {
+	for _, f := range p.IgnoredGoFiles {
+		if !strings.HasSuffix(f, ".go") || hasPlatformSuffix(f) {
+			continue
+		}
+		expr, err := fileBuildConstraint(filepath.Join(p.Dir, f))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "vendor: %s: %s: reading build constraint: %v\n", p.ImportPath, f, err)
+			continue
+		}
+		if expr == nil {
+			fmt.Fprintf(os.Stderr, "vendor: %s: %s: excluded on every vendored platform with no recognizable build constraint; consider -all-platforms\n", p.ImportPath, f)
+		}
+	}
+}
+
+// fileBuildConstraint returns the parsed //go:build (or // +build)
+// constraint at the top of the named file, or nil if it has none.
+func fileBuildConstraint(path string) (constraint.Expr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if constraint.IsGoBuild(line) || constraint.IsPlusBuild(line) {
+			return constraint.Parse(line)
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "package ") {
+			break
+		}
+	}
+	return nil, sc.Err()
+}
+
 func copyPackage(p *Package) error {
-	vdir := filepath.Join("vendor", p.ImportPath)
+	vdir := filepath.Join(vendorRoot(), p.ImportPath)
 	if err := os.MkdirAll(vdir, 0755); err != nil {
 		return err
 	}
 
-	files := flatten(
+	fileLists := [][]string{
 		p.GoFiles,
 		p.CgoFiles,
-		p.IgnoredGoFiles,
 		p.CFiles,
 		p.CXXFiles,
 		p.MFiles,
@@ -242,17 +692,39 @@ func copyPackage(p *Package) error {
 		p.SwigFiles,
 		p.SwigCXXFiles,
 		p.SysoFiles,
-	)
+	}
+	if !*pruneFlag {
+		// Without -prune, keep copying every IgnoredGoFiles entry as
+		// before; with it, the ones still ignored after listPackages'
+		// platform union (see pruneIgnoredGoFiles) aren't needed by any
+		// platform being vendored for, so they're dropped.
+		fileLists = append(fileLists, p.IgnoredGoFiles)
+	}
+	files := flatten(fileLists...)
 
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr error
 	for _, fname := range files {
-		if err := copyFile(
-			filepath.Join(vdir, fname),
-			filepath.Join(p.Dir, fname),
-		); err != nil {
-			return err
-		}
+		fname := fname
+		wg.Add(1)
+		copyPool.run(func() {
+			defer wg.Done()
+			err := copyFile(
+				filepath.Join(vdir, fname),
+				filepath.Join(p.Dir, fname),
+			)
+			if err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+			}
+		})
 	}
-	return nil
+	wg.Wait()
+	return firstErr
 }
 
 func copyFile(dstpath, srcpath string) error {
@@ -270,26 +742,186 @@ func copyFile(dstpath, srcpath string) error {
 	return err
 }
 
+// rewriteImports walks every .go file under the vendor tree and rewrites
+// imports of any package vendored in this run from its original import
+// path to prefix + "/" + that path, so the relocated tree compiles
+// standalone without relying on vendor/-style auto-resolution.
+func rewriteImports(prefix string) error {
+	prefix = strings.TrimRight(prefix, "/")
+	root := filepath.Join(getwd(), vendorRoot())
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		return rewriteFileImports(path, prefix)
+	})
+}
+
+// rewriteFileImports rewrites the import specs of a single copied file in
+// place, preserving its formatting and comments via go/ast + go/format.
+func rewriteFileImports(path, prefix string) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	changed := false
+	for _, spec := range file.Imports {
+		imp, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || manifest[imp] == nil || strings.HasPrefix(imp, prefix+"/") {
+			continue
+		}
+		spec.Path.Value = strconv.Quote(prefix + "/" + imp)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return format.Node(f, fset, file)
+}
+
+// vcsKind identifies the version control system backing a source directory.
+type vcsKind string
+
+const (
+	vcsGit     vcsKind = "git"
+	vcsHg      vcsKind = "hg"
+	vcsBzr     vcsKind = "bzr"
+	vcsSvn     vcsKind = "svn"
+	vcsUnknown vcsKind = "unknown"
+)
+
+// findVCS walks up from dir looking for a VCS metadata directory, returning
+// the kind of VCS found and the directory it was rooted at. If none is
+// found before reaching the filesystem root, it returns vcsUnknown.
+func findVCS(dir string) (vcsKind, string) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return vcsUnknown, ""
+	}
+	for {
+		for meta, kind := range map[string]vcsKind{
+			".git": vcsGit,
+			".hg":  vcsHg,
+			".bzr": vcsBzr,
+			".svn": vcsSvn,
+		} {
+			if _, err := os.Stat(filepath.Join(dir, meta)); err == nil {
+				return kind, dir
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return vcsUnknown, ""
+		}
+		dir = parent
+	}
+}
+
+// commitHash returns a provenance string of the form "kind:revision" (with
+// a " (dirty)" suffix if the working tree has local modifications) for the
+// VCS backing dir. If dir isn't under a recognized VCS, it returns
+// "unknown:unknown" rather than failing the run.
 func commitHash(dir string) (string, error) {
-	// TODO: work with hg, bzr
-	cmd := exec.Command("git", "rev-parse", "HEAD")
+	kind, root := findVCS(dir)
+	if kind == vcsUnknown {
+		return "unknown:unknown", nil
+	}
+	rev, err := vcsRevision(kind, root)
+	if err != nil {
+		return fmt.Sprintf("%s:unknown", kind), err
+	}
+	commit := fmt.Sprintf("%s:%s", kind, rev)
+	if !vcsIsClean(kind, root) {
+		commit += " (dirty)"
+	}
+	return commit, nil
+}
+
+// vcsRevision returns the current revision identifier for the repository
+// rooted at dir, using the command appropriate for kind.
+func vcsRevision(kind vcsKind, dir string) (string, error) {
+	var cmd *exec.Cmd
+	switch kind {
+	case vcsGit:
+		cmd = exec.Command("git", "rev-parse", "HEAD")
+	case vcsHg:
+		cmd = exec.Command("hg", "identify", "--id")
+	case vcsBzr:
+		cmd = exec.Command("bzr", "revision-info")
+	case vcsSvn:
+		cmd = exec.Command("svnversion")
+	default:
+		return "unknown", nil
+	}
 	cmd.Dir = dir
 	cmd.Stderr = os.Stderr
 	out, err := cmd.Output()
 	if err != nil {
 		return "unknown", err
 	}
-	commit := string(bytes.TrimSpace(out))
-	if !isClean(dir) {
-		commit += " (dirty)"
+	rev := string(bytes.TrimSpace(out))
+	if kind == vcsBzr {
+		// "bzr revision-info" prints "<revno> <revision-id>"; keep the id.
+		if i := strings.LastIndexByte(rev, ' '); i >= 0 {
+			rev = rev[i+1:]
+		}
 	}
-	return commit, nil
+	return rev, nil
 }
 
-func isClean(dir string) bool {
-	cmd := exec.Command("git", "diff-index", "--quiet", "HEAD")
-	cmd.Dir = dir
-	return cmd.Run() == nil
+// vcsIsClean reports whether the working tree rooted at dir has no local
+// modifications, according to the VCS identified by kind. Errors running
+// the status command are treated as "not clean" rather than failing.
+// vcsIsClean reports whether dir has no uncommitted changes to tracked
+// files. Untracked files (build artifacts, editor droppings, and the
+// like) don't count as dirty, matching "git diff-index --quiet HEAD"'s
+// semantics of only looking at tracked modifications.
+func vcsIsClean(kind vcsKind, dir string) bool {
+	switch kind {
+	case vcsGit:
+		cmd := exec.Command("git", "diff-index", "--quiet", "HEAD")
+		cmd.Dir = dir
+		return cmd.Run() == nil
+	case vcsHg:
+		// -mar: modified, added, removed; excludes "?" (untracked) and
+		// "I" (ignored) files.
+		cmd := exec.Command("hg", "status", "-mar")
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		return err == nil && len(bytes.TrimSpace(out)) == 0
+	case vcsBzr:
+		cmd := exec.Command("bzr", "status", "--short")
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			return false
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if line != "" && !strings.HasPrefix(line, "?") {
+				return false
+			}
+		}
+		return true
+	case vcsSvn:
+		// -q suppresses unversioned ("?") entries.
+		cmd := exec.Command("svn", "status", "-q")
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		return err == nil && len(bytes.TrimSpace(out)) == 0
+	default:
+		return true
+	}
 }
 
 func flatten(sss ...[]string) (ss []string) {
@@ -298,3 +930,318 @@ func flatten(sss ...[]string) (ss []string) {
 	}
 	return
 }
+
+// lockEntry is the go.sum-inspired record kept for each vendored import
+// path in the manifest file: the upstream repo it came from, the version
+// (or commit) it was vendored at, and a content hash of the copied files.
+type lockEntry struct {
+	ImportPath string `json:"importPath"`
+	RepoRoot   string `json:"repoRoot"`
+	Version    string `json:"version"`
+	Hash       string `json:"hash"`
+}
+
+// lockEntries accumulates manifest entries for packages vendored during
+// this run, keyed by import path, for writeManifestEntries to merge into
+// the on-disk manifest.
+var lockEntries = map[string]*lockEntry{}
+
+// buildLockEntry computes the manifest entry for a package that has
+// already been copied into vendor/<p.ImportPath>.
+func buildLockEntry(p *Package) (*lockEntry, error) {
+	kind, root := findVCS(p.Dir)
+	rev := "unknown"
+	if kind != vcsUnknown {
+		var err error
+		rev, err = vcsRevision(kind, root)
+		if err != nil {
+			return nil, fmt.Errorf("resolving revision: %v", err)
+		}
+	} else {
+		root = p.Dir
+	}
+	vdir := filepath.Join(getwd(), vendorRoot(), p.ImportPath)
+	hash, err := hashVendorDir(vdir)
+	if err != nil {
+		return nil, fmt.Errorf("hashing vendored files: %v", err)
+	}
+	return &lockEntry{
+		ImportPath: p.ImportPath,
+		RepoRoot:   importPathForDir(p, root),
+		Version:    resolveVersion(kind, root, rev),
+		Hash:       hash,
+	}, nil
+}
+
+// importPathForDir maps p.Dir back through dir, an ancestor of p.Dir, to
+// derive the import path dir itself would have, by trimming the same
+// number of path elements off the tail of p.ImportPath.
+func importPathForDir(p *Package, dir string) string {
+	rel, err := filepath.Rel(dir, p.Dir)
+	if err != nil || rel == "." {
+		return p.ImportPath
+	}
+	n := len(strings.Split(filepath.ToSlash(rel), "/"))
+	segs := strings.Split(p.ImportPath, "/")
+	if n > 0 && n < len(segs) {
+		return strings.Join(segs[:len(segs)-n], "/")
+	}
+	return p.ImportPath
+}
+
+// licenseFilePrefixes are the conventional basenames (case-insensitive,
+// allowing any suffix such as ".txt" or ".md") that carry redistribution
+// terms and so must travel with a vendored package.
+var licenseFilePrefixes = []string{"LICENSE", "COPYING", "NOTICE", "PATENTS"}
+
+// licenseFilesIn returns the license-like files directly inside dir, or
+// nil if dir doesn't exist or has none.
+func licenseFilesIn(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := strings.ToUpper(e.Name())
+		for _, prefix := range licenseFilePrefixes {
+			if strings.HasPrefix(name, prefix) {
+				files = append(files, e.Name())
+				break
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// copyLicenses copies any LICENSE/COPYING/NOTICE/PATENTS files found in
+// p's package directory or any ancestor up to its repo root (so a license
+// at the top of a repo travels with every sub-package vendored from it),
+// reporting whether at least one was found.
+func copyLicenses(p *Package) (bool, error) {
+	kind, root := findVCS(p.Dir)
+	if kind == vcsUnknown {
+		root = p.Dir
+	}
+	found := false
+	for dir := p.Dir; ; {
+		names, err := licenseFilesIn(dir)
+		if err != nil {
+			return found, err
+		}
+		if len(names) > 0 {
+			destDir := filepath.Join(vendorRoot(), importPathForDir(p, dir))
+			// An ancestor directory (e.g. a repo root) is shared by every
+			// sub-package vendored from it, so concurrent vendorPackage
+			// calls can reach the same destDir at once; claim it so only
+			// one of them actually copies its files.
+			if claimLicenseDir(destDir) {
+				if err := os.MkdirAll(destDir, 0755); err != nil {
+					return found, err
+				}
+				for _, name := range names {
+					if err := copyFile(filepath.Join(destDir, name), filepath.Join(dir, name)); err != nil {
+						return found, err
+					}
+				}
+			}
+			found = true
+		}
+		if dir == root {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return found, nil
+}
+
+// resolveVersion picks a human-meaningful version string for a vendored
+// package: an exact tag if the VCS has one checked out, else the revision
+// together with its commit date.
+func resolveVersion(kind vcsKind, dir, rev string) string {
+	switch kind {
+	case vcsGit:
+		cmd := exec.Command("git", "describe", "--tags", "--exact-match")
+		cmd.Dir = dir
+		if out, err := cmd.Output(); err == nil {
+			return strings.TrimSpace(string(out))
+		}
+		return rev + "-" + vcsCommitDate("git", dir, "log", "-1", "--format=%cd", "--date=short")
+	case vcsHg:
+		cmd := exec.Command("hg", "log", "-r", ".", "--template", "{latesttag}")
+		cmd.Dir = dir
+		if out, err := cmd.Output(); err == nil {
+			if tag := strings.TrimSpace(string(out)); tag != "" && tag != "null" {
+				return tag
+			}
+		}
+		return rev + "-" + vcsCommitDate("hg", dir, "log", "-r", ".", "--template", "{date|shortdate}")
+	default:
+		return rev
+	}
+}
+
+// vcsCommitDate runs a VCS command expected to print a single date and
+// returns it, or "unknown" if the command fails.
+func vcsCommitDate(name, dir string, args ...string) string {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// hashVendorDir computes a SHA-256 digest over the regular files copied
+// directly into vdir, in the style of go.sum's "h1:" dirhash: each file is
+// hashed individually, then the sorted "hash  path\n" lines are hashed
+// together so the result only depends on file contents and relative paths.
+//
+// vdir is not walked recursively: a vendored package's subdirectories are
+// always other vendored packages (Go packages are one directory each), and
+// each has its own lock entry, so descending into them here would make a
+// package's hash depend on its subpackages' contents and report drift in
+// the wrong entry.
+func hashVendorDir(vdir string) (string, error) {
+	entries, err := os.ReadDir(vdir)
+	if err != nil {
+		return "", err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			files = append(files, e.Name())
+		}
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(vdir, f))
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(h, "%x  %s\n", sum, f)
+	}
+	return fmt.Sprintf("h1:%x", h.Sum(nil)), nil
+}
+
+// readLockFile loads the manifest, returning an empty manifest if it
+// doesn't exist yet.
+func readLockFile(name string) (map[string]*lockEntry, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]*lockEntry{}, nil
+		}
+		return nil, err
+	}
+	lock := map[string]*lockEntry{}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", name, err)
+	}
+	return lock, nil
+}
+
+// writeLockFile writes the manifest back out as indented JSON, keyed by
+// import path.
+func writeLockFile(name string, lock map[string]*lockEntry) error {
+	data, err := json.MarshalIndent(lock, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	return os.WriteFile(name, data, 0666)
+}
+
+// writeManifestEntries merges the entries gathered during this run's
+// vendoring into the on-disk manifest and writes it back out.
+func writeManifestEntries(name string) error {
+	lock, err := readLockFile(name)
+	if err != nil {
+		return err
+	}
+	for imp, entry := range lockEntries {
+		lock[imp] = entry
+	}
+	return writeLockFile(name, lock)
+}
+
+// verifyManifest re-hashes every package recorded in the manifest and
+// reports (to stderr) any whose vendored contents have drifted from the
+// recorded hash, returning an error if any did.
+func verifyManifest(name string) error {
+	lock, err := readLockFile(name)
+	if err != nil {
+		return err
+	}
+	var imps []string
+	for imp := range lock {
+		imps = append(imps, imp)
+	}
+	sort.Strings(imps)
+	var drifted []string
+	for _, imp := range imps {
+		vdir := filepath.Join(getwd(), vendorRoot(), imp)
+		hash, err := hashVendorDir(vdir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", imp, err)
+			drifted = append(drifted, imp)
+			continue
+		}
+		if hash != lock[imp].Hash {
+			fmt.Fprintf(os.Stderr, "%s: hash mismatch: manifest has %s, vendor tree has %s\n", imp, lock[imp].Hash, hash)
+			drifted = append(drifted, imp)
+		}
+	}
+	if len(drifted) > 0 {
+		return fmt.Errorf("%d package(s) drifted from %s", len(drifted), name)
+	}
+	return nil
+}
+
+// updateManifest refreshes the manifest entries for names (or, if none are
+// given, every import path already in the manifest) by re-reading their
+// source VCS state and re-hashing their already-vendored files, without
+// re-copying anything.
+func updateManifest(names []string, manifestfile string) error {
+	lock, err := readLockFile(manifestfile)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		for imp := range lock {
+			names = append(names, imp)
+		}
+		sort.Strings(names)
+	}
+	ps, err := listPackages(names)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		if p.Error != nil {
+			log.Printf("encountered package error: %v", p.Error.Err)
+			continue
+		}
+		entry, err := buildLockEntry(p)
+		if err != nil {
+			log.Printf("%s: %v", p.ImportPath, err)
+			continue
+		}
+		lock[p.ImportPath] = entry
+	}
+	return writeLockFile(manifestfile, lock)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnionStrings(t *testing.T) {
+	got := unionStrings([]string{"a", "b"}, []string{"b", "c"})
+	want := []string{"a", "b", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("unionStrings() = %v, want %v", got, want)
+	}
+	for i, s := range want {
+		if got[i] != s {
+			t.Fatalf("unionStrings() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPruneIgnoredGoFiles(t *testing.T) {
+	p := &Package{
+		GoFiles:        []string{"foo_linux.go"},
+		IgnoredGoFiles: []string{"foo_linux.go", "foo_darwin.go"},
+	}
+	pruneIgnoredGoFiles(p)
+	if len(p.IgnoredGoFiles) != 1 || p.IgnoredGoFiles[0] != "foo_darwin.go" {
+		t.Fatalf("IgnoredGoFiles = %v, want [foo_darwin.go]", p.IgnoredGoFiles)
+	}
+}
+
+func TestImportPathForDir(t *testing.T) {
+	p := &Package{Dir: "/gopath/src/example.com/dep/sub1", ImportPath: "example.com/dep/sub1"}
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{"/gopath/src/example.com/dep/sub1", "example.com/dep/sub1"}, // p.Dir itself
+		{"/gopath/src/example.com/dep", "example.com/dep"},           // one level up
+	}
+	for _, tc := range tests {
+		if got := importPathForDir(p, tc.dir); got != tc.want {
+			t.Errorf("importPathForDir(%q) = %q, want %q", tc.dir, got, tc.want)
+		}
+	}
+}
+
+func TestFindVCS(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	kind, found := findVCS(sub)
+	if kind != vcsGit {
+		t.Fatalf("findVCS(%q) kind = %v, want vcsGit", sub, kind)
+	}
+	if abs, _ := filepath.Abs(root); found != abs {
+		t.Fatalf("findVCS(%q) root = %q, want %q", sub, found, abs)
+	}
+
+	other := t.TempDir()
+	if kind, _ := findVCS(other); kind != vcsUnknown {
+		t.Fatalf("findVCS(%q) = %v, want vcsUnknown", other, kind)
+	}
+}
+
+func TestResolveVersionDefault(t *testing.T) {
+	if v := resolveVersion(vcsUnknown, "", "deadbeef"); v != "deadbeef" {
+		t.Fatalf("resolveVersion(vcsUnknown) = %q, want %q", v, "deadbeef")
+	}
+}
+
+func TestHashVendorDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.go"), []byte("package a\n\nvar B int\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h1, err := hashVendorDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := hashVendorDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 != h2 {
+		t.Fatalf("hashVendorDir not deterministic: %q vs %q", h1, h2)
+	}
+
+	// A subdirectory is always a different vendored package with its own
+	// lock entry; its contents must not affect this directory's hash.
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "c.go"), []byte("package sub\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h3, err := hashVendorDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h3 != h1 {
+		t.Fatalf("hashVendorDir changed after adding a subdirectory: %q vs %q", h3, h1)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n\n// changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h4, err := hashVendorDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h4 == h1 {
+		t.Fatal("hashVendorDir did not change after editing a file")
+	}
+}
+
+func TestRewriteFileImports(t *testing.T) {
+	if _, err := exec.LookPath("gofmt"); err != nil {
+		t.Skip("gofmt not available")
+	}
+
+	saved := manifest
+	manifest = map[string]*Package{
+		"example.com/dep": {ImportPath: "example.com/dep"},
+	}
+	defer func() { manifest = saved }()
+
+	src := "package p\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/dep\"\n)\n\nfunc Hello() string { return dep.Hello() }\n"
+	path := filepath.Join(t.TempDir(), "p.go")
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rewriteFileImports(path, "vendored"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package p\n\nimport (\n\t\"fmt\"\n\n\t\"vendored/example.com/dep\"\n)\n\nfunc Hello() string { return dep.Hello() }\n"
+	if string(got) != want {
+		t.Fatalf("rewriteFileImports rewrote file as:\n%s\nwant:\n%s", got, want)
+	}
+}